@@ -0,0 +1,314 @@
+// Package bson implements a sockets.Codec backed by a small, self-contained
+// BSON (http://bsonspec.org) encoder/decoder, in the spirit of the minimal
+// Go BSON ports that predate a vendored driver dependency. It only covers
+// the element types struct and map codecs need day to day: double,
+// string, embedded document, array, boolean, int32, int64 and null.
+// Anything else (binary, dates, object ids, ...) is out of scope.
+package bson
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	elemDouble   byte = 0x01
+	elemString   byte = 0x02
+	elemDocument byte = 0x03
+	elemArray    byte = 0x04
+	elemBool     byte = 0x08
+	elemNull     byte = 0x0A
+	elemInt32    byte = 0x10
+	elemInt64    byte = 0x12
+)
+
+// Codec encodes and decodes messages as BSON binary frames.
+type Codec struct{}
+
+// Marshal encodes v, a struct or map[string]interface{}, as a BSON
+// document.
+func (Codec) Marshal(v interface{}) (int, []byte, error) {
+	data, err := marshalDocument(reflect.ValueOf(v))
+	return websocket.BinaryMessage, data, err
+}
+
+// Unmarshal decodes a BSON document into v, which must be a pointer to a
+// struct or to a map[string]interface{}.
+func (Codec) Unmarshal(data []byte, v interface{}) error {
+	fields, err := unmarshalDocument(data)
+	if err != nil {
+		return err
+	}
+	return assignFields(fields, reflect.ValueOf(v))
+}
+
+// New allocates an empty document, used when Coded is called without an
+// explicit prototype.
+func (Codec) New() interface{} {
+	return map[string]interface{}{}
+}
+
+func marshalDocument(v reflect.Value) ([]byte, error) {
+	for v.Kind() == reflect.Ptr {
+		v = v.Elem()
+	}
+
+	var body bytes.Buffer
+	switch v.Kind() {
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if f.PkgPath != "" { // unexported
+				continue
+			}
+			name := f.Tag.Get("bson")
+			if name == "" {
+				name = f.Name
+			}
+			if err := marshalElem(&body, name, v.Field(i)); err != nil {
+				return nil, err
+			}
+		}
+	case reflect.Map:
+		for _, key := range v.MapKeys() {
+			if err := marshalElem(&body, fmt.Sprint(key.Interface()), v.MapIndex(key)); err != nil {
+				return nil, err
+			}
+		}
+	default:
+		return nil, fmt.Errorf("bson: cannot marshal %s as a document", v.Kind())
+	}
+
+	return wrapDocument(body.Bytes()), nil
+}
+
+func wrapDocument(body []byte) []byte {
+	total := int32(len(body) + 5)
+	out := make([]byte, 0, total)
+	var lenBuf [4]byte
+	binary.LittleEndian.PutUint32(lenBuf[:], uint32(total))
+	out = append(out, lenBuf[:]...)
+	out = append(out, body...)
+	out = append(out, 0x00)
+	return out
+}
+
+func marshalElem(buf *bytes.Buffer, name string, v reflect.Value) error {
+	for v.Kind() == reflect.Interface {
+		v = v.Elem()
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		writeCString(buf, elemString, name)
+		s := v.String()
+		var lenBuf [4]byte
+		binary.LittleEndian.PutUint32(lenBuf[:], uint32(len(s)+1))
+		buf.Write(lenBuf[:])
+		buf.WriteString(s)
+		buf.WriteByte(0x00)
+	case reflect.Bool:
+		writeCString(buf, elemBool, name)
+		if v.Bool() {
+			buf.WriteByte(0x01)
+		} else {
+			buf.WriteByte(0x00)
+		}
+	case reflect.Int32, reflect.Int16, reflect.Int8:
+		writeCString(buf, elemInt32, name)
+		var b [4]byte
+		binary.LittleEndian.PutUint32(b[:], uint32(v.Int()))
+		buf.Write(b[:])
+	case reflect.Int, reflect.Int64:
+		writeCString(buf, elemInt64, name)
+		var b [8]byte
+		binary.LittleEndian.PutUint64(b[:], uint64(v.Int()))
+		buf.Write(b[:])
+	case reflect.Float32, reflect.Float64:
+		writeCString(buf, elemDouble, name)
+		var b [8]byte
+		binary.LittleEndian.PutUint64(b[:], math.Float64bits(v.Float()))
+		buf.Write(b[:])
+	case reflect.Slice, reflect.Array:
+		writeCString(buf, elemArray, name)
+		arr := make(map[string]interface{}, v.Len())
+		for i := 0; i < v.Len(); i++ {
+			arr[fmt.Sprint(i)] = v.Index(i).Interface()
+		}
+		doc, err := marshalDocument(reflect.ValueOf(arr))
+		if err != nil {
+			return err
+		}
+		buf.Write(doc)
+	case reflect.Struct, reflect.Map:
+		writeCString(buf, elemDocument, name)
+		doc, err := marshalDocument(v)
+		if err != nil {
+			return err
+		}
+		buf.Write(doc)
+	case reflect.Invalid:
+		writeCString(buf, elemNull, name)
+	default:
+		return fmt.Errorf("bson: unsupported field kind %s", v.Kind())
+	}
+
+	return nil
+}
+
+func writeCString(buf *bytes.Buffer, elemType byte, name string) {
+	buf.WriteByte(elemType)
+	buf.WriteString(name)
+	buf.WriteByte(0x00)
+}
+
+func unmarshalDocument(data []byte) (map[string]interface{}, error) {
+	if len(data) < 5 {
+		return nil, errors.New("bson: document too short")
+	}
+	body := data[4 : len(data)-1]
+
+	fields := make(map[string]interface{})
+	for len(body) > 0 {
+		elemType := body[0]
+		body = body[1:]
+
+		nul := bytes.IndexByte(body, 0x00)
+		if nul < 0 {
+			return nil, errors.New("bson: malformed element name")
+		}
+		name := string(body[:nul])
+		body = body[nul+1:]
+
+		value, rest, err := unmarshalValue(elemType, body)
+		if err != nil {
+			return nil, err
+		}
+		fields[name] = value
+		body = rest
+	}
+
+	return fields, nil
+}
+
+func unmarshalValue(elemType byte, body []byte) (interface{}, []byte, error) {
+	switch elemType {
+	case elemString:
+		if len(body) < 4 {
+			return nil, nil, errors.New("bson: truncated string length")
+		}
+		n := int(binary.LittleEndian.Uint32(body[:4]))
+		body = body[4:]
+		if n < 1 {
+			return nil, nil, errors.New("bson: invalid string length")
+		}
+		if n > len(body) {
+			return nil, nil, errors.New("bson: truncated string")
+		}
+		return string(body[:n-1]), body[n:], nil
+	case elemBool:
+		if len(body) < 1 {
+			return nil, nil, errors.New("bson: truncated bool")
+		}
+		return body[0] != 0, body[1:], nil
+	case elemInt32:
+		if len(body) < 4 {
+			return nil, nil, errors.New("bson: truncated int32")
+		}
+		return int32(binary.LittleEndian.Uint32(body[:4])), body[4:], nil
+	case elemInt64:
+		if len(body) < 8 {
+			return nil, nil, errors.New("bson: truncated int64")
+		}
+		return int64(binary.LittleEndian.Uint64(body[:8])), body[8:], nil
+	case elemDouble:
+		if len(body) < 8 {
+			return nil, nil, errors.New("bson: truncated double")
+		}
+		return math.Float64frombits(binary.LittleEndian.Uint64(body[:8])), body[8:], nil
+	case elemNull:
+		return nil, body, nil
+	case elemDocument, elemArray:
+		if len(body) < 4 {
+			return nil, nil, errors.New("bson: truncated document")
+		}
+		size := int(binary.LittleEndian.Uint32(body[:4]))
+		if size < 5 {
+			return nil, nil, errors.New("bson: invalid document length")
+		}
+		if size > len(body) {
+			return nil, nil, errors.New("bson: truncated document body")
+		}
+		fields, err := unmarshalDocument(body[:size])
+		if err != nil {
+			return nil, nil, err
+		}
+		if elemType == elemArray {
+			return fieldsToSlice(fields), body[size:], nil
+		}
+		return fields, body[size:], nil
+	default:
+		return nil, nil, fmt.Errorf("bson: unsupported element type 0x%02x", elemType)
+	}
+}
+
+func fieldsToSlice(fields map[string]interface{}) []interface{} {
+	out := make([]interface{}, len(fields))
+	for k, v := range fields {
+		var idx int
+		fmt.Sscanf(k, "%d", &idx)
+		if idx >= 0 && idx < len(out) {
+			out[idx] = v
+		}
+	}
+	return out
+}
+
+func assignFields(fields map[string]interface{}, v reflect.Value) error {
+	if v.Kind() != reflect.Ptr || v.IsNil() {
+		return errors.New("bson: Unmarshal target must be a non-nil pointer")
+	}
+	v = v.Elem()
+
+	switch v.Kind() {
+	case reflect.Map:
+		if v.IsNil() {
+			v.Set(reflect.MakeMap(v.Type()))
+		}
+		for k, val := range fields {
+			v.SetMapIndex(reflect.ValueOf(k), reflect.ValueOf(val))
+		}
+		return nil
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if f.PkgPath != "" {
+				continue
+			}
+			name := f.Tag.Get("bson")
+			if name == "" {
+				name = f.Name
+			}
+			val, ok := fields[name]
+			if !ok || val == nil {
+				continue
+			}
+			fv := v.Field(i)
+			rv := reflect.ValueOf(val)
+			if rv.Type().ConvertibleTo(fv.Type()) {
+				fv.Set(rv.Convert(fv.Type()))
+			}
+		}
+		return nil
+	default:
+		return fmt.Errorf("bson: cannot unmarshal into %s", v.Kind())
+	}
+}
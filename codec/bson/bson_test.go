@@ -0,0 +1,71 @@
+package bson
+
+import "testing"
+
+type message struct {
+	Text  string `bson:"text"`
+	Count int32  `bson:"count"`
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	var c Codec
+
+	messageType, data, err := c.Marshal(&message{Text: "Hello World", Count: 3})
+	if err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+	if messageType != 2 { // websocket.BinaryMessage
+		t.Errorf("Expected BinaryMessage, got %d", messageType)
+	}
+
+	var out message
+	if err := c.Unmarshal(data, &out); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+	if out.Text != "Hello World" || out.Count != 3 {
+		t.Errorf("Expected %+v, got %+v", message{Text: "Hello World", Count: 3}, out)
+	}
+}
+
+func TestCodecRoundTripEmptyString(t *testing.T) {
+	var c Codec
+
+	_, data, err := c.Marshal(&message{Text: ""})
+	if err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+
+	var out message
+	if err := c.Unmarshal(data, &out); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+	if out.Text != "" {
+		t.Errorf("Expected empty string, got %q", out.Text)
+	}
+}
+
+// TestUnmarshalMalformedDoesNotPanic guards against peer-controlled length
+// fields in the hand-rolled decoder causing out-of-range slice panics
+// instead of returning an error.
+func TestUnmarshalMalformedDoesNotPanic(t *testing.T) {
+	cases := map[string][]byte{
+		"zero-length string":   {0x0c, 0x00, 0x00, 0x00, elemString, 't', 0x00, 0x00, 0x00, 0x00, 0x00, 0x00},
+		"truncated string len": {0x07, 0x00, 0x00, 0x00, elemString, 't', 0x00, 0x00},
+		"truncated document":   {0x05, 0x00, 0x00, 0x00},
+		"negative-ish size":    {0x0c, 0x00, 0x00, 0x00, elemDocument, 'd', 0x00, 0xff, 0xff, 0xff, 0xff, 0x00},
+		"empty input":          {},
+	}
+
+	var c Codec
+	for name, data := range cases {
+		var out map[string]interface{}
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					t.Errorf("%s: Unmarshal panicked: %v", name, r)
+				}
+			}()
+			c.Unmarshal(data, &out)
+		}()
+	}
+}
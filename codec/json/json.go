@@ -0,0 +1,28 @@
+// Package json implements a sockets.Codec backed by encoding/json.
+package json
+
+import (
+	"encoding/json"
+
+	"github.com/gorilla/websocket"
+)
+
+// Codec encodes and decodes messages as JSON text frames.
+type Codec struct{}
+
+// Marshal encodes v as a JSON text message.
+func (Codec) Marshal(v interface{}) (int, []byte, error) {
+	data, err := json.Marshal(v)
+	return websocket.TextMessage, data, err
+}
+
+// Unmarshal decodes a JSON payload into v.
+func (Codec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+// New allocates an empty map, used when Coded is called without an
+// explicit prototype.
+func (Codec) New() interface{} {
+	return map[string]interface{}{}
+}
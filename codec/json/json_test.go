@@ -0,0 +1,27 @@
+package json
+
+import "testing"
+
+type message struct {
+	Text string `json:"text"`
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	var c Codec
+
+	messageType, data, err := c.Marshal(&message{Text: "Hello World"})
+	if err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+	if messageType != 1 { // websocket.TextMessage
+		t.Errorf("Expected TextMessage, got %d", messageType)
+	}
+
+	var out message
+	if err := c.Unmarshal(data, &out); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+	if out.Text != "Hello World" {
+		t.Errorf("Expected %q, got %q", "Hello World", out.Text)
+	}
+}
@@ -0,0 +1,27 @@
+// Package msgpack implements a sockets.Codec backed by MessagePack.
+package msgpack
+
+import (
+	"github.com/gorilla/websocket"
+	"gopkg.in/vmihailenco/msgpack.v2"
+)
+
+// Codec encodes and decodes messages as MessagePack binary frames.
+type Codec struct{}
+
+// Marshal encodes v as a MessagePack binary message.
+func (Codec) Marshal(v interface{}) (int, []byte, error) {
+	data, err := msgpack.Marshal(v)
+	return websocket.BinaryMessage, data, err
+}
+
+// Unmarshal decodes a MessagePack payload into v.
+func (Codec) Unmarshal(data []byte, v interface{}) error {
+	return msgpack.Unmarshal(data, v)
+}
+
+// New allocates an empty map, used when Coded is called without an
+// explicit prototype.
+func (Codec) New() interface{} {
+	return map[string]interface{}{}
+}
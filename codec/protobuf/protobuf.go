@@ -0,0 +1,41 @@
+// Package protobuf implements a sockets.Codec backed by Protocol Buffers.
+// It requires message values to implement proto.Message.
+package protobuf
+
+import (
+	"fmt"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/gorilla/websocket"
+)
+
+// Codec encodes and decodes messages as Protocol Buffers binary frames.
+type Codec struct{}
+
+// Marshal encodes v, which must implement proto.Message, as a binary
+// message.
+func (Codec) Marshal(v interface{}) (int, []byte, error) {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return websocket.BinaryMessage, nil, fmt.Errorf("protobuf: %T does not implement proto.Message", v)
+	}
+	data, err := proto.Marshal(m)
+	return websocket.BinaryMessage, data, err
+}
+
+// Unmarshal decodes a Protocol Buffers payload into v, which must
+// implement proto.Message.
+func (Codec) Unmarshal(data []byte, v interface{}) error {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return fmt.Errorf("protobuf: %T does not implement proto.Message", v)
+	}
+	return proto.Unmarshal(data, m)
+}
+
+// New has no sensible generic implementation for protobuf, since every
+// message type is its own generated struct; Coded requires an explicit
+// prototype when used with this codec.
+func (Codec) New() interface{} {
+	panic("sockets/codec/protobuf: Coded requires an explicit prototype; there is no generic proto.Message")
+}
@@ -0,0 +1,253 @@
+package sockets
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+
+	"github.com/gorilla/websocket"
+	"gopkg.in/macaron.v1"
+)
+
+// SlowClientPolicy decides what a Hub does with a client whose send buffer
+// is already full when a broadcast reaches it.
+type SlowClientPolicy int
+
+const (
+	// SlowClientDrop silently discards the broadcast for that client; the
+	// connection is left open.
+	SlowClientDrop SlowClientPolicy = iota
+	// SlowClientDisconnect closes the client's connection instead of
+	// letting the broadcast pile up behind it.
+	SlowClientDisconnect
+)
+
+const defaultHubCommandBuffer = 256
+
+// HubOptions configures a Hub. A nil HubOptions is equivalent to the zero
+// value.
+type HubOptions struct {
+	// SlowClientPolicy controls what happens when a broadcast can't be
+	// delivered to a client without blocking. Defaults to SlowClientDrop.
+	SlowClientPolicy SlowClientPolicy
+}
+
+func newHubOptions(o *HubOptions) *HubOptions {
+	if o == nil {
+		o = &HubOptions{}
+	}
+	return o
+}
+
+// client is a single connection registered with a Hub. send is the same
+// channel value handed to the downstream handler by Broadcast, converted
+// to its send-only direction, so a broadcast is indistinguishable from the
+// handler sending the message itself.
+type client struct {
+	send       reflect.Value // chan<- T
+	msgType    reflect.Type  // T
+	disconnect chan<- int
+}
+
+func (c *client) deliver(msg reflect.Value, policy SlowClientPolicy) {
+	if msg.Type() != c.msgType {
+		return
+	}
+
+	chosen, _, _ := reflect.Select([]reflect.SelectCase{
+		{Dir: reflect.SelectSend, Chan: c.send, Send: msg},
+		{Dir: reflect.SelectDefault},
+	})
+	if chosen == 0 {
+		return
+	}
+
+	switch policy {
+	case SlowClientDisconnect:
+		select {
+		case c.disconnect <- websocket.CloseMessageTooBig:
+		default:
+		}
+	case SlowClientDrop:
+	}
+}
+
+// Conn is an opaque handle to a single upgraded connection, used to Join
+// and Leave Hub rooms from within a downstream handler.
+type Conn struct {
+	c *client
+}
+
+// Hub tracks which clients belong to which rooms and fans broadcasts out
+// to them. All room membership is owned by a single goroutine and mutated
+// only through cmds, so the hot broadcast path never takes a lock.
+type Hub struct {
+	opts *HubOptions
+	cmds chan func(rooms map[string]map[*client]struct{})
+}
+
+// NewHub creates a Hub and starts its owning goroutine.
+func NewHub(opts *HubOptions) *Hub {
+	h := &Hub{
+		opts: newHubOptions(opts),
+		cmds: make(chan func(map[string]map[*client]struct{}), defaultHubCommandBuffer),
+	}
+	go h.run()
+	return h
+}
+
+func (h *Hub) run() {
+	rooms := make(map[string]map[*client]struct{})
+	for cmd := range h.cmds {
+		cmd(rooms)
+	}
+}
+
+// Join adds conn to room, creating the room if it doesn't exist yet.
+func (h *Hub) Join(conn *Conn, room string) {
+	done := make(chan struct{})
+	h.cmds <- func(rooms map[string]map[*client]struct{}) {
+		clients, ok := rooms[room]
+		if !ok {
+			clients = make(map[*client]struct{})
+			rooms[room] = clients
+		}
+		clients[conn.c] = struct{}{}
+		close(done)
+	}
+	<-done
+}
+
+// Leave removes conn from room. It is a no-op if conn was not in room.
+func (h *Hub) Leave(conn *Conn, room string) {
+	done := make(chan struct{})
+	h.cmds <- func(rooms map[string]map[*client]struct{}) {
+		if clients, ok := rooms[room]; ok {
+			delete(clients, conn.c)
+			if len(clients) == 0 {
+				delete(rooms, room)
+			}
+		}
+		close(done)
+	}
+	<-done
+}
+
+// leaveAll removes conn from every room it belongs to. It is called once a
+// connection's underlying socket goes away.
+func (h *Hub) leaveAll(conn *Conn) {
+	done := make(chan struct{})
+	h.cmds <- func(rooms map[string]map[*client]struct{}) {
+		for room, clients := range rooms {
+			if _, ok := clients[conn.c]; ok {
+				delete(clients, conn.c)
+				if len(clients) == 0 {
+					delete(rooms, room)
+				}
+			}
+		}
+		close(done)
+	}
+	<-done
+}
+
+// Clients reports how many connections currently belong to room.
+func (h *Hub) Clients(room string) int {
+	result := make(chan int, 1)
+	h.cmds <- func(rooms map[string]map[*client]struct{}) {
+		result <- len(rooms[room])
+	}
+	return <-result
+}
+
+// Broadcast sends msg to every connection currently in room. msg must be
+// of the room's channel element type, i.e. *T for connections upgraded by
+// Broadcast, the macaron.Handler, with a prototype of type T; connections
+// registered with a different message type are skipped. Slow clients are
+// handled per h's SlowClientPolicy.
+func (h *Hub) Broadcast(room string, msg interface{}) {
+	v := reflect.ValueOf(msg)
+	done := make(chan struct{})
+	h.cmds <- func(rooms map[string]map[*client]struct{}) {
+		for c := range rooms[room] {
+			c.deliver(v, h.opts.SlowClientPolicy)
+		}
+		close(done)
+	}
+	<-done
+}
+
+// Broadcast returns a Macaron handler that upgrades the connection like
+// JSON does, then automatically Joins the Hub room named by the ":room"
+// route parameter for the lifetime of the connection (and Leaves it once
+// the connection closes). The downstream handler may additionally declare
+// a *sockets.Conn parameter to Join/Leave further rooms of its own
+// choosing, on top of whatever JSON already provides.
+func Broadcast(hub *Hub, proto interface{}, options ...*Options) macaron.Handler {
+	opts := newOptions(options)
+	msgType := reflect.PtrTo(reflect.TypeOf(proto))
+
+	return func(ctx *macaron.Context) {
+		if status, reason := opts.preflight(ctx.Req.Request); status != 0 {
+			http.Error(ctx.Resp, reason, status)
+			return
+		}
+		if !opts.checkSubprotocol(ctx.Req.Request) {
+			http.Error(ctx.Resp, "sockets: no matching subprotocol", http.StatusBadRequest)
+			return
+		}
+		ws, err := opts.upgrader().Upgrade(ctx.Resp, ctx.Req.Request, nil)
+		if err != nil {
+			opts.logf(LogLevelError, "sockets: upgrade failed: %v", err)
+			return
+		}
+		opts.configureConn(ws)
+
+		c := newConn(ws, opts)
+		recvChan := reflect.MakeChan(reflect.ChanOf(reflect.BothDir, msgType), opts.RecvChannelBuffer)
+		sendChan := reflect.MakeChan(reflect.ChanOf(reflect.BothDir, msgType), opts.SendChannelBuffer)
+
+		conn := &Conn{c: &client{
+			send:       sendChan.Convert(reflect.ChanOf(reflect.SendDir, msgType)),
+			msgType:    msgType,
+			disconnect: c.disconnect,
+		}}
+
+		room := ctx.Params(":room")
+		hub.Join(conn, room)
+
+		go func() {
+			defer c.closeDone()
+			c.setupReadDeadlines()
+			for {
+				msg := reflect.New(msgType.Elem())
+				if err := ws.ReadJSON(msg.Interface()); err != nil {
+					opts.logf(LogLevelDebug, "sockets: read failed: %v", err)
+					return
+				}
+				recvChan.Send(msg)
+			}
+		}()
+
+		go c.writePump(func(v reflect.Value) (int, []byte, error) {
+			data, err := json.Marshal(v.Interface())
+			return websocket.TextMessage, data, err
+		}, sendChan)
+
+		go func() {
+			<-c.done
+			hub.leaveAll(conn)
+		}()
+
+		ctx.Map(conn)
+		ctx.Map(recvChan.Convert(reflect.ChanOf(reflect.RecvDir, msgType)).Interface())
+		ctx.Map(sendChan.Convert(reflect.ChanOf(reflect.SendDir, msgType)).Interface())
+		var done <-chan bool = c.done
+		ctx.Map(done)
+		var disconnect chan<- int = c.disconnect
+		ctx.Map(disconnect)
+
+		ctx.Next()
+		c.closeDone()
+	}
+}
@@ -0,0 +1,125 @@
+package sockets
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func newTestClient(buffer int) (*client, chan string, chan int) {
+	send := make(chan string, buffer)
+	disconnect := make(chan int, 1)
+	c := &client{
+		send:       reflect.ValueOf(send),
+		msgType:    reflect.TypeOf(""),
+		disconnect: disconnect,
+	}
+	return c, send, disconnect
+}
+
+func TestHubJoinAndBroadcast(t *testing.T) {
+	hub := NewHub(nil)
+	c, send, _ := newTestClient(1)
+	conn := &Conn{c: c}
+
+	hub.Join(conn, "room")
+	if got := hub.Clients("room"); got != 1 {
+		t.Fatalf("Expected 1 client in room, got %d", got)
+	}
+
+	hub.Broadcast("room", "hello")
+
+	select {
+	case msg := <-send:
+		if msg != "hello" {
+			t.Errorf("Expected %q, got %q", "hello", msg)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected broadcast to be delivered")
+	}
+}
+
+func TestHubLeave(t *testing.T) {
+	hub := NewHub(nil)
+	c, _, _ := newTestClient(1)
+	conn := &Conn{c: c}
+
+	hub.Join(conn, "room")
+	hub.Leave(conn, "room")
+
+	if got := hub.Clients("room"); got != 0 {
+		t.Fatalf("Expected 0 clients in room after Leave, got %d", got)
+	}
+}
+
+func TestHubLeaveAllOnDisconnect(t *testing.T) {
+	hub := NewHub(nil)
+	c, _, _ := newTestClient(1)
+	conn := &Conn{c: c}
+
+	hub.Join(conn, "room-a")
+	hub.Join(conn, "room-b")
+	hub.leaveAll(conn)
+
+	if got := hub.Clients("room-a"); got != 0 {
+		t.Errorf("Expected 0 clients in room-a, got %d", got)
+	}
+	if got := hub.Clients("room-b"); got != 0 {
+		t.Errorf("Expected 0 clients in room-b, got %d", got)
+	}
+}
+
+func TestHubBroadcastSkipsMismatchedType(t *testing.T) {
+	hub := NewHub(nil)
+	c, send, _ := newTestClient(1)
+	conn := &Conn{c: c}
+
+	hub.Join(conn, "room")
+	hub.Broadcast("room", 42) // wrong type for a chan string client
+
+	select {
+	case msg := <-send:
+		t.Fatalf("Expected nothing to be delivered, got %q", msg)
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+func TestHubSlowClientDrop(t *testing.T) {
+	hub := NewHub(&HubOptions{SlowClientPolicy: SlowClientDrop})
+	c, send, disconnect := newTestClient(0) // unbuffered: every send blocks
+	conn := &Conn{c: c}
+
+	hub.Join(conn, "room")
+	hub.Broadcast("room", "first")
+	hub.Broadcast("room", "second")
+
+	select {
+	case code := <-disconnect:
+		t.Fatalf("Expected no disconnect under SlowClientDrop, got code %d", code)
+	default:
+	}
+	if got := hub.Clients("room"); got != 1 {
+		t.Errorf("Expected client to remain in room, got %d clients", got)
+	}
+	_ = send
+}
+
+func TestHubSlowClientDisconnect(t *testing.T) {
+	hub := NewHub(&HubOptions{SlowClientPolicy: SlowClientDisconnect})
+	c, _, disconnect := newTestClient(0) // unbuffered: every send blocks
+	conn := &Conn{c: c}
+
+	hub.Join(conn, "room")
+	hub.Broadcast("room", "first")
+
+	select {
+	case code := <-disconnect:
+		if code != websocket.CloseMessageTooBig {
+			t.Errorf("Expected close code %d, got %d", websocket.CloseMessageTooBig, code)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected a disconnect under SlowClientDisconnect")
+	}
+}
@@ -0,0 +1,612 @@
+// Package sockets provides WebSocket handlers for Macaron, exposing each
+// connection to the application as a pair of typed Go channels instead of
+// a raw *websocket.Conn.
+package sockets
+
+import (
+	"compress/flate"
+	"log"
+	"net/http"
+	"net/url"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	jsoncodec "github.com/wuhan005/macaron-sockets/codec/json"
+	"gopkg.in/macaron.v1"
+)
+
+// LogLevel controls how verbosely a connection logs its lifecycle events.
+type LogLevel int
+
+const (
+	LogLevelNone LogLevel = iota
+	LogLevelError
+	LogLevelWarn
+	LogLevelInfo
+	LogLevelDebug
+)
+
+const (
+	defaultWriteWait         = 10 * time.Second
+	defaultPongWait          = 60 * time.Second
+	defaultPingPeriod        = (defaultPongWait * 9) / 10
+	defaultMaxMessageSize    int64 = 512
+	defaultSendChannelBuffer = 256
+	defaultRecvChannelBuffer = 256
+	defaultLogLevel          = LogLevelNone
+	defaultCompressionLevel  = flate.BestSpeed
+)
+
+// Options configures the behavior of a socket handler. A nil or zero-valued
+// field falls back to its documented default.
+type Options struct {
+	// LogLevel controls how much is written to the standard logger about
+	// connection lifecycle events (upgrade failures, reads, writes, ...).
+	LogLevel LogLevel
+
+	// WriteWait is the time allowed to write a message to the peer.
+	WriteWait time.Duration
+	// PongWait is the time allowed to read the next pong message from the peer.
+	PongWait time.Duration
+	// PingPeriod is how often ping messages are sent to the peer. It should
+	// be kept comfortably below PongWait.
+	PingPeriod time.Duration
+	// MaxMessageSize is the maximum message size allowed from the peer, in bytes.
+	MaxMessageSize int64
+
+	// SendChannelBuffer is the buffer size of the channel handed to the
+	// downstream handler for outgoing messages.
+	SendChannelBuffer int
+	// RecvChannelBuffer is the buffer size of the channel handed to the
+	// downstream handler for incoming messages.
+	RecvChannelBuffer int
+
+	// AllowedOrigin is a regular expression matched against the request's
+	// Origin header. Kept for backwards compatibility; prefer
+	// AllowedOrigins for new code.
+	AllowedOrigin string
+	// AllowedOrigins is a list of exact origins allowed to connect, e.g.
+	// "https://example.com". An entry may contain "*" as a wildcard,
+	// e.g. "https://*.example.com".
+	AllowedOrigins []string
+	// AllowSameOrigin allows requests whose Origin host matches the
+	// request's Host, regardless of AllowedOrigin/AllowedOrigins. Nil
+	// defaults to true, matching gorilla/websocket's own default
+	// behavior; set to a false pointer to require an explicit allow-list
+	// match even for same-origin requests.
+	AllowSameOrigin *bool
+	// CheckOrigin, when non-nil, is used as-is and takes precedence over
+	// AllowedOrigin, AllowedOrigins and AllowSameOrigin.
+	CheckOrigin func(r *http.Request) bool
+
+	// EnableCompression negotiates the permessage-deflate extension
+	// (RFC 7692) with the peer during the handshake.
+	EnableCompression bool
+	// CompressionLevel is the flate compression level used once
+	// permessage-deflate is negotiated. Defaults to flate.BestSpeed.
+	CompressionLevel int
+	// CompressionThreshold is the minimum outgoing message size, in bytes,
+	// before compression is applied to a given write. Messages smaller
+	// than this are sent uncompressed even when EnableCompression is set.
+	// Zero means always compress.
+	CompressionThreshold int
+
+	// Subprotocols is the list of application subprotocols this handler
+	// is willing to speak, in preference order. It is offered to the
+	// peer during the handshake via Sec-WebSocket-Protocol, and the
+	// negotiated value is echoed back by gorilla/websocket automatically.
+	Subprotocols []string
+	// RequireSubprotocol rejects the handshake with 400 Bad Request when
+	// the peer didn't offer any subprotocol in Subprotocols.
+	RequireSubprotocol bool
+}
+
+// newOptions merges the (at most one) user-supplied Options with the
+// package defaults, returning a fully-populated Options ready to use.
+func newOptions(options []*Options) *Options {
+	var o Options
+	if len(options) > 0 && options[0] != nil {
+		o = *options[0]
+	}
+
+	if o.WriteWait == 0 {
+		o.WriteWait = defaultWriteWait
+	}
+	if o.PongWait == 0 {
+		o.PongWait = defaultPongWait
+	}
+	if o.PingPeriod == 0 {
+		o.PingPeriod = defaultPingPeriod
+	}
+	if o.MaxMessageSize == 0 {
+		o.MaxMessageSize = defaultMaxMessageSize
+	}
+	if o.SendChannelBuffer == 0 {
+		o.SendChannelBuffer = defaultSendChannelBuffer
+	}
+	if o.RecvChannelBuffer == 0 {
+		o.RecvChannelBuffer = defaultRecvChannelBuffer
+	}
+	if o.CompressionLevel == 0 {
+		o.CompressionLevel = defaultCompressionLevel
+	}
+
+	return &o
+}
+
+func (o *Options) logf(level LogLevel, format string, args ...interface{}) {
+	if o.LogLevel >= level {
+		log.Printf(format, args...)
+	}
+}
+
+// upgrader builds the gorilla/websocket Upgrader for these Options,
+// wiring in the CheckOrigin function built by originChecker.
+func (o *Options) upgrader() *websocket.Upgrader {
+	u := &websocket.Upgrader{
+		ReadBufferSize:    1024,
+		WriteBufferSize:   1024,
+		EnableCompression: o.EnableCompression,
+		Subprotocols:      o.Subprotocols,
+		CheckOrigin:       o.originChecker(),
+	}
+	return u
+}
+
+// originChecker builds the origin-checking function used both as the
+// Upgrader's CheckOrigin and by preflight, honoring, in order of
+// precedence: an explicit Options.CheckOrigin, then AllowSameOrigin,
+// AllowedOrigin and AllowedOrigins together. When none of those are
+// configured, it reproduces gorilla/websocket's own same-origin default.
+func (o *Options) originChecker() func(r *http.Request) bool {
+	if o.CheckOrigin != nil {
+		return o.CheckOrigin
+	}
+
+	allowSameOrigin := o.AllowSameOrigin == nil || *o.AllowSameOrigin
+	if o.AllowedOrigin == "" && len(o.AllowedOrigins) == 0 {
+		if !allowSameOrigin {
+			return func(r *http.Request) bool { return false }
+		}
+		return func(r *http.Request) bool {
+			origin := r.Header.Get("Origin")
+			if origin == "" {
+				return true
+			}
+			u, err := url.Parse(origin)
+			return err == nil && strings.EqualFold(u.Host, r.Host)
+		}
+	}
+
+	var legacy *regexp.Regexp
+	if o.AllowedOrigin != "" {
+		legacy = regexp.MustCompile(o.AllowedOrigin)
+	}
+	patterns := make([]*regexp.Regexp, len(o.AllowedOrigins))
+	for i, p := range o.AllowedOrigins {
+		patterns[i] = wildcardToRegexp(p)
+	}
+
+	return func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			return true
+		}
+		if allowSameOrigin {
+			if u, err := url.Parse(origin); err == nil && u.Host == r.Host {
+				return true
+			}
+		}
+		if legacy != nil && legacy.MatchString(origin) {
+			return true
+		}
+		for _, re := range patterns {
+			if re.MatchString(origin) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// preflight rejects the request outright, before attempting the
+// websocket handshake, when its method isn't GET or its origin is
+// disallowed. It returns a zero status when the request may proceed.
+func (o *Options) preflight(r *http.Request) (status int, reason string) {
+	if r.Method != http.MethodGet {
+		return http.StatusMethodNotAllowed, "sockets: method not allowed"
+	}
+	if !o.originChecker()(r) {
+		return http.StatusForbidden, "sockets: origin not allowed"
+	}
+	return 0, ""
+}
+
+// wildcardToRegexp compiles an origin pattern, where "*" matches any run
+// of characters, into an anchored regular expression.
+func wildcardToRegexp(pattern string) *regexp.Regexp {
+	parts := strings.Split(pattern, "*")
+	for i, p := range parts {
+		parts[i] = regexp.QuoteMeta(p)
+	}
+	return regexp.MustCompile("^" + strings.Join(parts, ".*") + "$")
+}
+
+// offeredSubprotocols splits a Sec-WebSocket-Protocol request header into
+// its comma-separated, trimmed values.
+func offeredSubprotocols(r *http.Request) []string {
+	header := r.Header.Get("Sec-WebSocket-Protocol")
+	if header == "" {
+		return nil
+	}
+	parts := strings.Split(header, ",")
+	protocols := make([]string, 0, len(parts))
+	for _, p := range parts {
+		if p = strings.TrimSpace(p); p != "" {
+			protocols = append(protocols, p)
+		}
+	}
+	return protocols
+}
+
+// checkSubprotocol reports whether the handshake should proceed given
+// RequireSubprotocol: true unless Subprotocols and RequireSubprotocol are
+// both set and none of the peer's offered subprotocols match.
+func (o *Options) checkSubprotocol(r *http.Request) bool {
+	if !o.RequireSubprotocol || len(o.Subprotocols) == 0 {
+		return true
+	}
+	offered := offeredSubprotocols(r)
+	for _, want := range o.Subprotocols {
+		for _, got := range offered {
+			if want == got {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// configureConn applies the per-connection compression settings that
+// can't be expressed on the Upgrader itself.
+func (o *Options) configureConn(ws *websocket.Conn) {
+	if !o.EnableCompression {
+		return
+	}
+	ws.EnableWriteCompression(true)
+	ws.SetCompressionLevel(o.CompressionLevel)
+}
+
+// shouldCompress reports whether a write of size n should have
+// compression enabled, given o's EnableCompression/CompressionThreshold.
+func (o *Options) shouldCompress(n int) bool {
+	return o.EnableCompression && n >= o.CompressionThreshold
+}
+
+// conn bundles the pieces of state that are common to every connection,
+// regardless of the wire format used for messages.
+type conn struct {
+	ws   *websocket.Conn
+	opts *Options
+
+	done       chan bool
+	closeOnce  sync.Once
+	disconnect chan int
+}
+
+func newConn(ws *websocket.Conn, opts *Options) *conn {
+	return &conn{
+		ws:         ws,
+		opts:       opts,
+		done:       make(chan bool),
+		disconnect: make(chan int, 1),
+	}
+}
+
+// closeDone signals done exactly once, regardless of which pump noticed
+// the connection going away first.
+func (c *conn) closeDone() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+	})
+}
+
+// writePump relays outgoing messages and periodic pings to the peer until
+// done is closed or the downstream handler asks to disconnect. write is
+// called for every value sent on sendChan to encode it into a websocket
+// message type and payload.
+func (c *conn) writePump(write func(v reflect.Value) (messageType int, data []byte, err error), sendChan reflect.Value) {
+	ticker := time.NewTicker(c.opts.PingPeriod)
+	defer ticker.Stop()
+	defer c.ws.Close()
+
+	cases := []reflect.SelectCase{
+		{Dir: reflect.SelectRecv, Chan: sendChan},
+		{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(c.done)},
+		{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(c.disconnect)},
+		{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(ticker.C)},
+	}
+
+	for {
+		chosen, v, _ := reflect.Select(cases)
+		switch chosen {
+		case 0:
+			messageType, data, err := write(v)
+			if err != nil {
+				c.opts.logf(LogLevelError, "sockets: encode failed: %v", err)
+				c.closeDone()
+				return
+			}
+			c.ws.EnableWriteCompression(c.opts.shouldCompress(len(data)))
+			c.ws.SetWriteDeadline(time.Now().Add(c.opts.WriteWait))
+			if err := c.ws.WriteMessage(messageType, data); err != nil {
+				c.opts.logf(LogLevelError, "sockets: write failed: %v", err)
+				c.closeDone()
+				return
+			}
+		case 1:
+			return
+		case 2:
+			code := int(v.Int())
+			c.ws.SetWriteDeadline(time.Now().Add(c.opts.WriteWait))
+			c.ws.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(code, ""))
+			c.closeDone()
+			return
+		case 3:
+			c.ws.SetWriteDeadline(time.Now().Add(c.opts.WriteWait))
+			if err := c.ws.WriteMessage(websocket.PingMessage, nil); err != nil {
+				c.closeDone()
+				return
+			}
+		}
+	}
+}
+
+func (c *conn) setupReadDeadlines() {
+	c.ws.SetReadLimit(c.opts.MaxMessageSize)
+	c.ws.SetReadDeadline(time.Now().Add(c.opts.PongWait))
+	c.ws.SetPongHandler(func(string) error {
+		c.ws.SetReadDeadline(time.Now().Add(c.opts.PongWait))
+		return nil
+	})
+}
+
+// Codec defines how Coded converts between application values and
+// websocket wire messages for a particular message format.
+type Codec interface {
+	// Marshal encodes v, returning the websocket message type
+	// (websocket.TextMessage or websocket.BinaryMessage) it should be
+	// sent as and the payload.
+	Marshal(v interface{}) (messageType int, data []byte, err error)
+	// Unmarshal decodes data, as produced by Marshal, into v.
+	Unmarshal(data []byte, v interface{}) error
+	// New allocates a fresh value of the codec's own container type. It is
+	// only consulted by Coded when called with a nil prototype.
+	New() interface{}
+}
+
+// Coded returns a Macaron handler that upgrades the connection and
+// exposes it to the next handler as channels of *T, using codec to
+// marshal/unmarshal messages on the wire. T is the type of prototype, or
+// the dynamic type of codec.New() if prototype is nil. The downstream
+// handler may declare any combination of:
+//
+//	receiver <-chan *T
+//	sender   chan<- *T
+//	done     <-chan bool
+//	disconnect chan<- int
+func Coded(prototype interface{}, codec Codec, options ...*Options) macaron.Handler {
+	opts := newOptions(options)
+	if prototype == nil {
+		prototype = codec.New()
+	}
+	msgType := reflect.PtrTo(reflect.TypeOf(prototype))
+
+	return func(ctx *macaron.Context) {
+		if status, reason := opts.preflight(ctx.Req.Request); status != 0 {
+			http.Error(ctx.Resp, reason, status)
+			return
+		}
+		if !opts.checkSubprotocol(ctx.Req.Request) {
+			http.Error(ctx.Resp, "sockets: no matching subprotocol", http.StatusBadRequest)
+			return
+		}
+		ws, err := opts.upgrader().Upgrade(ctx.Resp, ctx.Req.Request, nil)
+		if err != nil {
+			opts.logf(LogLevelError, "sockets: upgrade failed: %v", err)
+			return
+		}
+		opts.configureConn(ws)
+
+		c := newConn(ws, opts)
+		recvChan := reflect.MakeChan(reflect.ChanOf(reflect.BothDir, msgType), opts.RecvChannelBuffer)
+		sendChan := reflect.MakeChan(reflect.ChanOf(reflect.BothDir, msgType), opts.SendChannelBuffer)
+
+		go func() {
+			defer c.closeDone()
+			c.setupReadDeadlines()
+			for {
+				_, data, err := ws.ReadMessage()
+				if err != nil {
+					opts.logf(LogLevelDebug, "sockets: read failed: %v", err)
+					return
+				}
+				msg := reflect.New(msgType.Elem())
+				if err := codec.Unmarshal(data, msg.Interface()); err != nil {
+					opts.logf(LogLevelError, "sockets: decode failed: %v", err)
+					return
+				}
+				recvChan.Send(msg)
+			}
+		}()
+
+		go c.writePump(func(v reflect.Value) (int, []byte, error) {
+			return codec.Marshal(v.Interface())
+		}, sendChan)
+
+		ctx.Map(recvChan.Convert(reflect.ChanOf(reflect.RecvDir, msgType)).Interface())
+		ctx.Map(sendChan.Convert(reflect.ChanOf(reflect.SendDir, msgType)).Interface())
+		var done <-chan bool = c.done
+		ctx.Map(done)
+		var disconnect chan<- int = c.disconnect
+		ctx.Map(disconnect)
+
+		ctx.Next()
+		c.closeDone()
+	}
+}
+
+// JSON returns a Macaron handler that upgrades the connection and exposes
+// it to the next handler as channels of *T, where T is the type of proto.
+// It is a thin wrapper around Coded using the JSON wire format. See Coded
+// for the supported handler parameter shapes.
+func JSON(proto interface{}, options ...*Options) macaron.Handler {
+	return Coded(proto, jsoncodec.Codec{}, options...)
+}
+
+// Messages returns a Macaron handler that upgrades the connection and
+// exposes it to the next handler as channels of string. See JSON for the
+// supported handler parameter shapes.
+func Messages(options ...*Options) macaron.Handler {
+	opts := newOptions(options)
+
+	return func(ctx *macaron.Context) {
+		if status, reason := opts.preflight(ctx.Req.Request); status != 0 {
+			http.Error(ctx.Resp, reason, status)
+			return
+		}
+		if !opts.checkSubprotocol(ctx.Req.Request) {
+			http.Error(ctx.Resp, "sockets: no matching subprotocol", http.StatusBadRequest)
+			return
+		}
+		ws, err := opts.upgrader().Upgrade(ctx.Resp, ctx.Req.Request, nil)
+		if err != nil {
+			opts.logf(LogLevelError, "sockets: upgrade failed: %v", err)
+			return
+		}
+		opts.configureConn(ws)
+
+		c := newConn(ws, opts)
+		recvChan := make(chan string, opts.RecvChannelBuffer)
+		sendChan := make(chan string, opts.SendChannelBuffer)
+
+		go func() {
+			defer c.closeDone()
+			c.setupReadDeadlines()
+			for {
+				_, data, err := ws.ReadMessage()
+				if err != nil {
+					opts.logf(LogLevelDebug, "sockets: read failed: %v", err)
+					return
+				}
+				recvChan <- string(data)
+			}
+		}()
+
+		go c.writePump(func(v reflect.Value) (int, []byte, error) {
+			return websocket.TextMessage, []byte(v.String()), nil
+		}, reflect.ValueOf(sendChan))
+
+		var recv <-chan string = recvChan
+		ctx.Map(recv)
+		var send chan<- string = sendChan
+		ctx.Map(send)
+		var done <-chan bool = c.done
+		ctx.Map(done)
+		var disconnect chan<- int = c.disconnect
+		ctx.Map(disconnect)
+
+		ctx.Next()
+		c.closeDone()
+	}
+}
+
+// ByteSliceMessages returns a Macaron handler that upgrades the connection
+// and exposes it to the next handler as channels of []byte. See JSON for
+// the supported handler parameter shapes.
+func ByteSliceMessages(options ...*Options) macaron.Handler {
+	opts := newOptions(options)
+
+	return func(ctx *macaron.Context) {
+		if status, reason := opts.preflight(ctx.Req.Request); status != 0 {
+			http.Error(ctx.Resp, reason, status)
+			return
+		}
+		if !opts.checkSubprotocol(ctx.Req.Request) {
+			http.Error(ctx.Resp, "sockets: no matching subprotocol", http.StatusBadRequest)
+			return
+		}
+		ws, err := opts.upgrader().Upgrade(ctx.Resp, ctx.Req.Request, nil)
+		if err != nil {
+			opts.logf(LogLevelError, "sockets: upgrade failed: %v", err)
+			return
+		}
+		opts.configureConn(ws)
+
+		c := newConn(ws, opts)
+		recvChan := make(chan []byte, opts.RecvChannelBuffer)
+		sendChan := make(chan []byte, opts.SendChannelBuffer)
+
+		go func() {
+			defer c.closeDone()
+			c.setupReadDeadlines()
+			for {
+				_, data, err := ws.ReadMessage()
+				if err != nil {
+					opts.logf(LogLevelDebug, "sockets: read failed: %v", err)
+					return
+				}
+				if opts.EnableCompression {
+					// With compression enabled, data aliases the
+					// decompressor's internal buffer, which the next
+					// ReadMessage call is free to overwrite; copy it
+					// before handing it to the consumer.
+					data = append([]byte(nil), data...)
+				}
+				recvChan <- data
+			}
+		}()
+
+		go c.writePump(func(v reflect.Value) (int, []byte, error) {
+			return websocket.BinaryMessage, v.Bytes(), nil
+		}, reflect.ValueOf(sendChan))
+
+		var recv <-chan []byte = recvChan
+		ctx.Map(recv)
+		var send chan<- []byte = sendChan
+		ctx.Map(send)
+		var done <-chan bool = c.done
+		ctx.Map(done)
+		var disconnect chan<- int = c.disconnect
+		ctx.Map(disconnect)
+
+		ctx.Next()
+		c.closeDone()
+	}
+}
+
+// Dispatch returns a Macaron handler that routes a connection to a
+// different handler depending on which subprotocol the peer offered in
+// Sec-WebSocket-Protocol. routes is keyed by subprotocol name; each value
+// is typically a JSON/Messages/ByteSliceMessages/Coded handler configured
+// with that same name in its own Options.Subprotocols, so the eventual
+// upgrade still negotiates and echoes it correctly. The first subprotocol
+// offered by the peer that has a route wins; if none match, the request
+// fails with 400 Bad Request.
+func Dispatch(routes map[string]macaron.Handler) macaron.Handler {
+	return func(ctx *macaron.Context) {
+		for _, name := range offeredSubprotocols(ctx.Req.Request) {
+			if h, ok := routes[name]; ok {
+				if _, err := ctx.Invoke(h); err != nil {
+					http.Error(ctx.Resp, "sockets: dispatch failed: "+err.Error(), http.StatusInternalServerError)
+				}
+				return
+			}
+		}
+		http.Error(ctx.Resp, "sockets: no matching subprotocol", http.StatusBadRequest)
+	}
+}
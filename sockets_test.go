@@ -11,6 +11,8 @@ import (
 
 	"gopkg.in/macaron.v1"
 	"github.com/gorilla/websocket"
+	msgpackcodec "github.com/wuhan005/macaron-sockets/codec/msgpack"
+	"gopkg.in/vmihailenco/msgpack.v2"
 )
 
 const (
@@ -25,6 +27,9 @@ const (
 	sendByteSlicePath string = "/byteslice/sender"
 	pingStringsPath   string = "/strings/ping"
 	crossOriginPath   string = "/cross/origin"
+	compressedPath    string = "/compressed/receiver"
+	dispatchPath      string = "/dispatch/receiver"
+	msgpackPath       string = "/msgpack/receiver"
 )
 
 type Message struct {
@@ -51,6 +56,11 @@ var (
 	sendStringsCount      int
 	sendStringsDone       bool
 	sendByteSlicesDone    bool
+	recvCompressed        [][]byte
+	recvCompressedDone    bool
+	recvCompressedArrived = make(chan struct{}, 1)
+	recvMsgpack           []*Message
+	recvMsgpackArrived    = make(chan struct{}, 1)
 )
 
 // Test Helpers
@@ -254,6 +264,49 @@ func startServer() {
 		return http.StatusOK
 	})
 
+	m.Get(compressedPath, ByteSliceMessages(&Options{EnableCompression: true, MaxMessageSize: 1 << 20}), func(context *macaron.Context, receiver <-chan []byte, done <-chan bool) int {
+		for {
+			select {
+			case msg := <-receiver:
+				recvCompressed = append(recvCompressed, msg)
+				select {
+				case recvCompressedArrived <- struct{}{}:
+				default:
+				}
+			case <-done:
+				recvCompressedDone = true
+				return http.StatusOK
+			}
+		}
+
+		return http.StatusOK
+	})
+
+	m.Get(msgpackPath, Coded(Message{}, msgpackcodec.Codec{}), func(context *macaron.Context, receiver <-chan *Message, done <-chan bool) int {
+		for {
+			select {
+			case msg := <-receiver:
+				recvMsgpack = append(recvMsgpack, msg)
+				select {
+				case recvMsgpackArrived <- struct{}{}:
+				default:
+				}
+			case <-done:
+				return http.StatusOK
+			}
+		}
+
+		return http.StatusOK
+	})
+
+	m.Get(dispatchPath, Dispatch(map[string]macaron.Handler{
+		"chat.v1": Messages(&Options{Subprotocols: []string{"chat.v1"}}),
+		"chat.v2": ByteSliceMessages(&Options{Subprotocols: []string{"chat.v2"}}),
+	}), func(context *macaron.Context, done <-chan bool) int {
+		<-done
+		return http.StatusOK
+	})
+
 	go m.Run()
 	time.Sleep(5 * time.Millisecond)
 }
@@ -422,6 +475,135 @@ func TestJSONSend(t *testing.T) {
 	expectIsDone(t, sendDone)
 }
 
+func TestCompressionNegotiation(t *testing.T) {
+	once.Do(startServer)
+
+	header := make(http.Header)
+	header.Add("Origin", host)
+	dialer := *websocket.DefaultDialer
+	dialer.EnableCompression = true
+
+	ws, resp, err := dialer.Dial(endpoint+compressedPath, header)
+	if err != nil {
+		t.Fatalf("Connecting the socket failed: %s", err.Error())
+	}
+	defer ws.Close()
+
+	expectStatusCode(t, http.StatusSwitchingProtocols, resp.StatusCode)
+	if !strings.Contains(resp.Header.Get("Sec-WebSocket-Extensions"), "permessage-deflate") {
+		t.Errorf("Expected Sec-WebSocket-Extensions to contain \"permessage-deflate\", but was %q", resp.Header.Get("Sec-WebSocket-Extensions"))
+	}
+}
+
+func TestCompressedByteSliceRoundTrip(t *testing.T) {
+	once.Do(startServer)
+
+	header := make(http.Header)
+	header.Add("Origin", host)
+	dialer := *websocket.DefaultDialer
+	dialer.EnableCompression = true
+
+	ws, _, err := dialer.Dial(endpoint+compressedPath, header)
+	if err != nil {
+		t.Fatalf("Connecting the socket failed: %s", err.Error())
+	}
+	defer ws.Close()
+
+	large := strings.Repeat("Hello World", 10000)
+	if err := ws.WriteMessage(websocket.BinaryMessage, []byte(large)); err != nil {
+		t.Fatalf("Writing to the socket failed: %s", err.Error())
+	}
+
+	select {
+	case <-recvCompressedArrived:
+	case <-time.After(time.Second):
+		t.Fatalf("Expected a compressed message to have arrived")
+	}
+
+	if string(recvCompressed[0]) != large {
+		t.Errorf("Expected the large payload to arrive intact, but it was truncated or corrupted")
+	}
+}
+
+// TestMsgpackCoded exercises Coded itself end to end with a non-JSON
+// codec: a raw msgpack-encoded frame is written straight to the wire and
+// must arrive decoded on the other side, proving Coded's generic
+// marshal/unmarshal plumbing rather than just the msgpack codec in
+// isolation.
+func TestMsgpackCoded(t *testing.T) {
+	once.Do(startServer)
+
+	ws, resp := connectSocket(t, msgpackPath)
+	defer ws.Close()
+
+	data, err := msgpack.Marshal(&Message{Text: "Hello World"})
+	if err != nil {
+		t.Fatalf("Marshaling the message failed: %s", err.Error())
+	}
+	if err := ws.WriteMessage(websocket.BinaryMessage, data); err != nil {
+		t.Fatalf("Writing to the socket failed: %s", err.Error())
+	}
+
+	select {
+	case <-recvMsgpackArrived:
+	case <-time.After(time.Second):
+		t.Fatalf("Expected a msgpack message to have arrived")
+	}
+
+	expectStatusCode(t, http.StatusSwitchingProtocols, resp.StatusCode)
+	if recvMsgpack[0].Text != "Hello World" {
+		t.Errorf("Expected %q, got %q", "Hello World", recvMsgpack[0].Text)
+	}
+}
+
+func TestDispatchNegotiatesFirstOfferedMatch(t *testing.T) {
+	once.Do(startServer)
+
+	header := make(http.Header)
+	header.Add("Origin", host)
+	header.Add("Sec-WebSocket-Protocol", "chat.v2, chat.v1")
+
+	ws, resp, err := websocket.DefaultDialer.Dial(endpoint+dispatchPath, header)
+	if err != nil {
+		t.Fatalf("Connecting the socket failed: %s", err.Error())
+	}
+	defer ws.Close()
+
+	expectStatusCode(t, http.StatusSwitchingProtocols, resp.StatusCode)
+	expectSame(t, resp.Header.Get("Sec-WebSocket-Protocol"), "chat.v2")
+}
+
+func TestDispatchNoMatchingSubprotocol(t *testing.T) {
+	once.Do(startServer)
+
+	header := make(http.Header)
+	header.Add("Origin", host)
+	header.Add("Sec-WebSocket-Protocol", "chat.v3")
+
+	_, resp, err := websocket.DefaultDialer.Dial(endpoint+dispatchPath, header)
+	if err == nil {
+		t.Fatalf("Expected the handshake to be rejected")
+	}
+	expectStatusCode(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestRequireSubprotocolRejectsMissingOffer(t *testing.T) {
+	m := macaron.Classic()
+
+	recorder := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/test", strings.NewReader(""))
+	if err != nil {
+		t.Error(err)
+	}
+
+	m.Any("/test", Messages(&Options{Subprotocols: []string{"chat.v1"}, RequireSubprotocol: true}), func() int {
+		return http.StatusOK
+	})
+
+	m.ServeHTTP(recorder, req)
+	expectStatusCode(t, http.StatusBadRequest, recorder.Code)
+}
+
 func TestOptionsDefaultHandling(t *testing.T) {
 	o := newOptions([]*Options{
 		&Options{
@@ -477,6 +659,125 @@ func TestDisallowedCrossOrigin(t *testing.T) {
 	expectStatusCode(t, http.StatusForbidden, recorder.Code)
 }
 
+func TestAllowedOriginsWildcard(t *testing.T) {
+	m := macaron.Classic()
+
+	recorder := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/test", strings.NewReader(""))
+	req.Header.Add("Origin", "https://foo.example.com")
+	if err != nil {
+		t.Error(err)
+	}
+
+	m.Any("/test", Messages(&Options{AllowedOrigins: []string{"https://*.example.com"}}), func() int {
+		return http.StatusOK
+	})
+
+	m.ServeHTTP(recorder, req)
+	// Origin check passes, so the request fails at the handshake stage.
+	expectStatusCode(t, http.StatusBadRequest, recorder.Code)
+}
+
+func TestAllowedOriginsMultipleEntries(t *testing.T) {
+	m := macaron.Classic()
+
+	recorder := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/test", strings.NewReader(""))
+	req.Header.Add("Origin", "https://b.com")
+	if err != nil {
+		t.Error(err)
+	}
+
+	m.Any("/test", Messages(&Options{AllowedOrigins: []string{"https://a.com", "https://b.com"}}), func() int {
+		return http.StatusOK
+	})
+
+	m.ServeHTTP(recorder, req)
+	expectStatusCode(t, http.StatusBadRequest, recorder.Code)
+}
+
+func TestAllowedOriginsDisallowsUnlistedOrigin(t *testing.T) {
+	m := macaron.Classic()
+
+	recorder := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/test", strings.NewReader(""))
+	req.Header.Add("Origin", "https://evil.com")
+	if err != nil {
+		t.Error(err)
+	}
+
+	m.Any("/test", Messages(&Options{AllowedOrigins: []string{"https://a.com", "https://b.com"}}), func() int {
+		return http.StatusOK
+	})
+
+	m.ServeHTTP(recorder, req)
+	expectStatusCode(t, http.StatusForbidden, recorder.Code)
+}
+
+func TestCheckOriginFuncTakesPrecedence(t *testing.T) {
+	m := macaron.Classic()
+
+	recorder := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/test", strings.NewReader(""))
+	req.Header.Add("Origin", "https://anything.example")
+	if err != nil {
+		t.Error(err)
+	}
+
+	m.Any("/test", Messages(&Options{
+		AllowedOrigins: []string{"https://never-matches.invalid"},
+		CheckOrigin:    func(r *http.Request) bool { return true },
+	}), func() int {
+		return http.StatusOK
+	})
+
+	m.ServeHTTP(recorder, req)
+	expectStatusCode(t, http.StatusBadRequest, recorder.Code)
+}
+
+func TestAllowSameOriginFastPath(t *testing.T) {
+	m := macaron.Classic()
+
+	recorder := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/test", strings.NewReader(""))
+	req.Host = "same.example.com"
+	req.Header.Add("Origin", "http://same.example.com")
+	if err != nil {
+		t.Error(err)
+	}
+
+	m.Any("/test", Messages(&Options{AllowedOrigins: []string{"https://unrelated.com"}}), func() int {
+		return http.StatusOK
+	})
+
+	m.ServeHTTP(recorder, req)
+	// Same-origin fast path lets it through despite not matching AllowedOrigins.
+	expectStatusCode(t, http.StatusBadRequest, recorder.Code)
+}
+
+func TestAllowSameOriginDisabled(t *testing.T) {
+	m := macaron.Classic()
+
+	recorder := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/test", strings.NewReader(""))
+	req.Host = "same.example.com"
+	req.Header.Add("Origin", "http://same.example.com")
+	if err != nil {
+		t.Error(err)
+	}
+
+	disallowSameOrigin := false
+	m.Any("/test", Messages(&Options{
+		AllowedOrigins:  []string{"https://unrelated.com"},
+		AllowSameOrigin: &disallowSameOrigin,
+	}), func() int {
+		return http.StatusOK
+	})
+
+	m.ServeHTTP(recorder, req)
+	expectStatusCode(t, http.StatusForbidden, recorder.Code)
+}
+
 func TestDisallowedMethods(t *testing.T) {
 	m := macaron.Classic()
 